@@ -0,0 +1,98 @@
+package main
+
+import (
+	"bufio"
+	"fmt"
+	"os"
+	"os/exec"
+	"strings"
+)
+
+// resolveGitHubToken returns a GitHub access token to use for an upload
+// endpoint that requires one, trying (in order) an explicit flag value and
+// the SRC_GITHUB_TOKEN and GITHUB_TOKEN environment variables. It is shared
+// by any `src` subcommand that needs to authenticate against GitHub on the
+// user's behalf. If none of these are set, the caller is expected to fall
+// back to the git credential helper (see gitCredentialFill) lazily, i.e.
+// only once the server actually rejects the request for lacking a token.
+func resolveGitHubToken(explicit string) string {
+	if explicit != "" {
+		return explicit
+	}
+	if token := os.Getenv("SRC_GITHUB_TOKEN"); token != "" {
+		return token
+	}
+	return os.Getenv("GITHUB_TOKEN")
+}
+
+// gitCredentialFill asks the git credential helper (the system default, or
+// helperCmd if non-empty) for credentials for the given HTTPS host. It
+// returns the username and password/token fields; the password field is
+// where GitHub personal access tokens are stored by credential helpers.
+func gitCredentialFill(host, helperCmd string) (username, password string, err error) {
+	input := fmt.Sprintf("protocol=https\nhost=%s\n\n", host)
+	out, err := runGitCredential(helperCmd, "fill", input)
+	if err != nil {
+		return "", "", err
+	}
+	attrs := parseGitCredentialOutput(out)
+	return attrs["username"], attrs["password"], nil
+}
+
+// gitCredentialApprove informs the credential helper that the given
+// credentials were used successfully, so it can persist them for future
+// invocations without prompting again.
+func gitCredentialApprove(host, username, password, helperCmd string) error {
+	input := fmt.Sprintf("protocol=https\nhost=%s\nusername=%s\npassword=%s\n\n", host, username, password)
+	_, err := runGitCredential(helperCmd, "approve", input)
+	return err
+}
+
+// gitCredentialReject informs the credential helper that the given
+// credentials were rejected by the server, so it can discard them (e.g.
+// forcing a re-prompt on the next run rather than handing back a stale,
+// revoked token).
+func gitCredentialReject(host, username, password, helperCmd string) error {
+	input := fmt.Sprintf("protocol=https\nhost=%s\nusername=%s\npassword=%s\n\n", host, username, password)
+	_, err := runGitCredential(helperCmd, "reject", input)
+	return err
+}
+
+// runGitCredential invokes `git credential <action>` (or the user-supplied
+// helperCmd in place of `git credential`, split on whitespace the same way
+// a shell alias would be) and feeds it input on stdin.
+func runGitCredential(helperCmd, action, input string) (string, error) {
+	var cmd *exec.Cmd
+	if helperCmd != "" {
+		parts := strings.Fields(helperCmd)
+		cmd = exec.Command(parts[0], append(parts[1:], action)...)
+	} else {
+		cmd = exec.Command("git", "credential", action)
+	}
+	cmd.Stdin = strings.NewReader(input)
+
+	out, err := cmd.Output()
+	if err != nil {
+		return "", fmt.Errorf("git credential %s: %w", action, err)
+	}
+	return string(out), nil
+}
+
+// parseGitCredentialOutput parses the key=value lines produced by
+// `git credential fill` into a map.
+func parseGitCredentialOutput(output string) map[string]string {
+	attrs := make(map[string]string)
+	scanner := bufio.NewScanner(strings.NewReader(output))
+	for scanner.Scan() {
+		line := scanner.Text()
+		if line == "" {
+			continue
+		}
+		parts := strings.SplitN(line, "=", 2)
+		if len(parts) != 2 {
+			continue
+		}
+		attrs[parts[0]] = parts[1]
+	}
+	return attrs
+}
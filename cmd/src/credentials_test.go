@@ -0,0 +1,62 @@
+package main
+
+import "testing"
+
+func TestParseGitCredentialOutput(t *testing.T) {
+	tests := []struct {
+		name   string
+		output string
+		want   map[string]string
+	}{
+		{
+			name:   "username and password",
+			output: "protocol=https\nhost=github.com\nusername=alice\npassword=s3cr3t\n",
+			want: map[string]string{
+				"protocol": "https",
+				"host":     "github.com",
+				"username": "alice",
+				"password": "s3cr3t",
+			},
+		},
+		{
+			name:   "value contains an equals sign",
+			output: "password=abc=def\n",
+			want:   map[string]string{"password": "abc=def"},
+		},
+		{
+			name:   "blank lines are skipped",
+			output: "host=github.com\n\npassword=s3cr3t\n",
+			want: map[string]string{
+				"host":     "github.com",
+				"password": "s3cr3t",
+			},
+		},
+		{
+			name:   "lines without an equals sign are skipped",
+			output: "host=github.com\nnot-a-key-value-line\npassword=s3cr3t\n",
+			want: map[string]string{
+				"host":     "github.com",
+				"password": "s3cr3t",
+			},
+		},
+		{
+			name:   "empty input",
+			output: "",
+			want:   map[string]string{},
+		},
+	}
+
+	for _, test := range tests {
+		t.Run(test.name, func(t *testing.T) {
+			got := parseGitCredentialOutput(test.output)
+			if len(got) != len(test.want) {
+				t.Fatalf("parseGitCredentialOutput(%q) = %v, want %v", test.output, got, test.want)
+			}
+			for k, v := range test.want {
+				if got[k] != v {
+					t.Errorf("parseGitCredentialOutput(%q)[%q] = %q, want %q", test.output, k, got[k], v)
+				}
+			}
+		})
+	}
+}
@@ -1,26 +1,72 @@
 package main
 
 import (
-	"bufio"
-	"compress/gzip"
 	"encoding/base64"
 	"encoding/json"
 	"flag"
 	"fmt"
-	"io"
-	"io/ioutil"
 	"net/http"
 	"net/url"
 	"os"
 	"os/exec"
 	"path/filepath"
 	"strings"
+	"time"
 
 	"github.com/kballard/go-shellquote"
 	"github.com/mattn/go-isatty"
 	"github.com/pkg/browser"
+
+	"github.com/sourcegraph/src-cli/lsif"
+	"github.com/sourcegraph/src-cli/lsif/transfer"
 )
 
+// defaultWaitTimeout is the deadline used for -wait when no duration is
+// given explicitly (e.g. bare "-wait" rather than "-wait=5m").
+const defaultWaitTimeout = 10 * time.Minute
+
+// Exit codes for -wait, distinct from the default 1 used for other
+// command-line errors so CI can tell "the server rejected the dump" apart
+// from "processing didn't finish in time."
+const (
+	exitCodeProcessingErrored = 2
+	exitCodeProcessingTimeout = 3
+)
+
+// waitFlagValue implements flag.Value (and the "boolean flag" convention
+// the flag package looks for) so that -wait can be passed either bare, to
+// wait with defaultWaitTimeout, or as -wait=<duration> for a custom one.
+type waitFlagValue struct {
+	set      bool
+	duration time.Duration
+}
+
+func (w *waitFlagValue) String() string {
+	if w == nil || !w.set {
+		return ""
+	}
+	return w.duration.String()
+}
+
+func (w *waitFlagValue) Set(s string) error {
+	if s == "" || s == "true" {
+		w.duration = defaultWaitTimeout
+		w.set = true
+		return nil
+	}
+	d, err := time.ParseDuration(s)
+	if err != nil {
+		return err
+	}
+	w.duration = d
+	w.set = true
+	return nil
+}
+
+// IsBoolFlag marks this flag as not requiring an explicit value, matching
+// how the standard library treats bool flags (e.g. "-v" vs "-v=true").
+func (w *waitFlagValue) IsBoolFlag() bool { return true }
+
 func isFlagSet(fs *flag.FlagSet, name string) bool {
 	var found bool
 	fs.Visit(func(f *flag.Flag) {
@@ -50,6 +96,10 @@ Examples:
   Upload an LSIF dump when the LSIF indexer does not not declare a tool name.
 
     	$ src lsif upload -indexerName=lsif-elixir
+
+  Upload an LSIF dump and wait for it to finish processing, as a CI gate:
+
+    	$ src lsif upload -wait
 `
 
 	flagSet := flag.NewFlagSet("upload", flag.ExitOnError)
@@ -59,35 +109,45 @@ Examples:
 		fmt.Println(usage)
 	}
 	var (
-		repoFlag        = flagSet.String("repo", "", `The name of the repository (e.g. github.com/gorilla/mux). By default, derived from the origin remote.`)
+		repoFlag        = flagSet.String("repo", "", `The name of the repository (e.g. github.com/gorilla/mux). By default, derived from the chosen remote.`)
+		remoteFlag      = flagSet.String("remote", "", `The git remote to derive the repository name from. Defaults to "origin", falling back to the first remote git lists.`)
 		commitFlag      = flagSet.String("commit", "", `The 40-character hash of the commit. Defaults to the currently checked-out commit.`)
 		fileFlag        = flagSet.String("file", "./dump.lsif", `The path to the LSIF dump file.`)
 		githubTokenFlag = flagSet.String("github-token", "", `A GitHub access token with 'public_repo' scope that Sourcegraph uses to verify you have access to the repository.`)
 		rootFlag        = flagSet.String("root", "", `The path in the repository that matches the LSIF projectRoot (e.g. cmd/project1). Defaults to the directory where the dump file is located.`)
 		indexerNameFlag = flagSet.String("indexerName", "", `The name of the indexer that generated the dump. This will override the 'toolInfo.name' field in the metadata vertex of the LSIF dump file. This must be supplied if the indexer does not set this field (in which case the upload will fail with an explicit message).`)
 		openFlag        = flagSet.Bool("open", false, `Open the LSIF upload page in your browser.`)
+		resumeFromFlag  = flagSet.String("resume-from", "", `An upload token previously printed by a failed upload. Resumes a chunked upload, skipping any parts the server already has.`)
+		credHelperFlag  = flagSet.String("credential-helper", "", `The "git credential" command to use to resolve a GitHub access token (e.g. a Vault-backed helper for CI). Defaults to "git credential".`)
+		noCredHelpFlag  = flagSet.Bool("no-credential-helper", false, `Don't fall back to the git credential helper to resolve a GitHub access token.`)
+		transferFlag    = flagSet.String("transfer", "basic", `The transfer adapter used to upload the dump: "basic" (gzip-POST straight to Sourcegraph) or "external" (hand off to a -transfer-agent-path subprocess, e.g. to push directly to S3/GCS/Azure Blob).`)
+		transferAgent   = flagSet.String("transfer-agent-path", "", `The path to the subprocess implementing the "external" transfer adapter. Required when -transfer=external.`)
+		jsonFlag        = flagSet.Bool("json", false, `Output relevant state in JSON on success (implies -wait if given without one). Only really useful with -wait.`)
 		apiFlags        = newAPIFlags(flagSet)
+		waitFlag        = &waitFlagValue{}
 	)
+	flagSet.Var(waitFlag, "wait", `Wait for the upload to finish processing (COMPLETED or ERRORED) before exiting, polling the Sourcegraph instance. Optionally takes a duration (e.g. -wait=5m) after which the command exits with a distinct "timed out" status; defaults to 10m.`)
 
 	handler := func(args []string) error {
 		flagSet.Parse(args)
 
+		if *jsonFlag && !waitFlag.set {
+			waitFlag.Set("")
+		}
+
 		if repoFlag == nil || *repoFlag == "" {
-			remoteURL, err := exec.Command("git", "remote", "get-url", "origin").Output()
+			repo, rule, err := resolveRepositoryFromGit(*remoteFlag)
 			if err != nil {
-				fmt.Printf("Failed to invoke git: %v\n", err)
+				fmt.Println(err)
 				fmt.Println("Unable to detect repository from environment.")
 				fmt.Println("Either cd into a git repository or set -repo explicitly.")
 				os.Exit(1)
 			}
-			*repoFlag, err = parseRemoteURL(strings.TrimSpace(string(remoteURL)))
-			if err != nil {
-				fmt.Println(err)
-				fmt.Println("Set -repo explicitly.")
-				os.Exit(1)
-			}
+			*repoFlag = repo
+			fmt.Printf("Repository: %s (detected via %s)\n", *repoFlag, rule)
+		} else {
+			fmt.Println("Repository: " + *repoFlag)
 		}
-		fmt.Println("Repository: " + *repoFlag)
 
 		if commitFlag == nil || *commitFlag == "" {
 			commit, err := exec.Command("git", "rev-parse", "HEAD").Output()
@@ -146,11 +206,13 @@ Examples:
 		// the rest of the commands as it does not use a GraphQL endpoint,
 		// using the path and query string instead of the body.
 
+		githubToken := resolveGitHubToken(*githubTokenFlag)
+
 		qs := url.Values{}
 		qs.Add("repository", *repoFlag)
 		qs.Add("commit", *commitFlag)
-		if *githubTokenFlag != "" {
-			qs.Add("github_token", *githubTokenFlag)
+		if githubToken != "" {
+			qs.Add("github_token", githubToken)
 		}
 		if *rootFlag != "" {
 			qs.Add("root", *rootFlag)
@@ -186,63 +248,70 @@ Examples:
 			return nil
 		}
 
-		f, err := os.Open(*fileFlag)
-		if err != nil {
-			return err
+		if *transferFlag != "basic" && *transferFlag != "external" {
+			return fmt.Errorf("invalid -transfer=%q: must be \"basic\" or \"external\"", *transferFlag)
 		}
-		defer f.Close()
 
-		// compress the file
-		pr, ch := gzipReader(f)
-
-		// Create the HTTP request.
-		req, err := http.NewRequest("POST", url.String(), pr)
-		if err != nil {
-			return err
+		uploader := &lsif.Uploader{
+			Endpoint:          cfg.Endpoint,
+			AccessToken:       cfg.AccessToken,
+			TransferAgentPath: *transferAgent,
+			Log: func(format string, args ...interface{}) {
+				fmt.Printf(format+"\n", args...)
+			},
 		}
-
-		req.Header.Set("Content-Type", "application/x-ndjson+lsif")
-		if cfg.AccessToken != "" {
-			req.Header.Set("Authorization", "token "+cfg.AccessToken)
+		if isFlagSet(flagSet, "transfer") {
+			uploader.PreferredTransfer = *transferFlag
 		}
 
-		// Perform the request.
-		resp, err := http.DefaultClient.Do(req)
-		if err != nil {
-			return err
-		}
-		defer resp.Body.Close()
+		// Try the resumable, chunked batch protocol first. Older Sourcegraph
+		// instances don't expose the batch endpoint yet, so fall back to the
+		// single-shot gzip+POST path on a 404. -transfer=external bypasses
+		// both of these in favor of handing the dump to a subprocess that
+		// pushes it straight into an operator-controlled object store.
+		attempt := func(githubToken string) (*lsif.UploadResult, error) {
+			if *transferFlag == "external" {
+				adapter := &transfer.ExternalAdapter{AgentPath: *transferAgent}
+				return uploader.UploadViaAdapter(*fileFlag, *repoFlag, *commitFlag, *rootFlag, *indexerNameFlag, githubToken, adapter)
+			}
 
-		// See if we had a reader error
-		if err := <-ch; err != nil {
-			return err
+			payload, err := uploader.UploadBatch(*fileFlag, *repoFlag, *commitFlag, *rootFlag, *indexerNameFlag, *resumeFromFlag, githubToken)
+			if err == lsif.ErrBatchUnsupported {
+				payload, err = uploader.UploadSingleShot(*fileFlag, *repoFlag, *commitFlag, *rootFlag, *indexerNameFlag, githubToken)
+			}
+			return payload, err
 		}
 
-		body, err := ioutil.ReadAll(resp.Body)
-		if err != nil {
-			return err
+		payload, err := attempt(githubToken)
+
+		if statusErr, ok := err.(*lsif.StatusError); ok && statusErr.StatusCode == http.StatusUnauthorized &&
+			strings.Contains(strings.ToLower(string(statusErr.Body)), "must provide github_token") && !*noCredHelpFlag {
+			host := strings.SplitN(*repoFlag, "/", 2)[0]
+			if username, password, credErr := gitCredentialFill(host, *credHelperFlag); credErr == nil && password != "" {
+				if retryPayload, retryErr := attempt(password); retryErr == nil {
+					gitCredentialApprove(host, username, password, *credHelperFlag)
+					payload, err = retryPayload, nil
+				} else {
+					if retryStatusErr, ok := retryErr.(*lsif.StatusError); ok && retryStatusErr.StatusCode == http.StatusUnauthorized {
+						gitCredentialReject(host, username, password, *credHelperFlag)
+					}
+					err = retryErr
+				}
+			}
 		}
 
-		// Our request may have failed before the reaching the upload endpoint, so
-		// confirm the status code. You can test this easily with e.g. an invalid
-		// endpoint like -endpoint=https://google.com
-		if resp.StatusCode < 200 || resp.StatusCode >= 300 {
-			if resp.StatusCode == http.StatusUnauthorized && strings.Contains(strings.ToLower(string(body)), "must provide github_token") {
-				return fmt.Errorf("error: you must provide -github-token=TOKEN, where TOKEN is a GitHub personal access token with 'repo' or 'public_repo' scope")
-			}
+		if err != nil {
+			if statusErr, ok := err.(*lsif.StatusError); ok {
+				if statusErr.StatusCode == http.StatusUnauthorized && strings.Contains(strings.ToLower(string(statusErr.Body)), "must provide github_token") {
+					return fmt.Errorf("error: you must provide -github-token=TOKEN, where TOKEN is a GitHub personal access token with 'repo' or 'public_repo' scope")
+				}
 
-			if resp.StatusCode == http.StatusUnauthorized && isatty.IsTerminal(os.Stdout.Fd()) {
-				fmt.Println("You may need to specify or update your GitHub access token to use this endpoint.")
-				fmt.Println("See https://github.com/sourcegraph/src-cli#authentication")
-				fmt.Println("")
+				if statusErr.StatusCode == http.StatusUnauthorized && isatty.IsTerminal(os.Stdout.Fd()) {
+					fmt.Println("You may need to specify or update your GitHub access token to use this endpoint.")
+					fmt.Println("See https://github.com/sourcegraph/src-cli#authentication")
+					fmt.Println("")
+				}
 			}
-			return fmt.Errorf("error: %s\n\n%s", resp.Status, body)
-		}
-
-		payload := struct {
-			ID string `json:"id"`
-		}{}
-		if err := json.Unmarshal(body, &payload); err != nil {
 			return err
 		}
 
@@ -259,6 +328,49 @@ Examples:
 			}
 		}
 
+		if waitFlag.set {
+			isTTY := isatty.IsTerminal(os.Stdout.Fd())
+			status, waitErr := uploader.WaitForProcessing(uploadID, waitFlag.duration, func(state string) {
+				if isTTY {
+					fmt.Printf("\rProcessing status: %s...", state)
+				} else {
+					fmt.Printf("Processing status: %s\n", state)
+				}
+			})
+			if isTTY {
+				fmt.Println()
+			}
+
+			if status == nil {
+				status = &lsif.ProcessingStatus{ID: uploadID}
+			}
+
+			if *jsonFlag {
+				out, err := json.Marshal(struct {
+					ID    string `json:"id"`
+					State string `json:"state"`
+					URL   string `json:"url"`
+				}{ID: status.ID, State: status.State, URL: uploadURL})
+				if err != nil {
+					return err
+				}
+				fmt.Println(string(out))
+			}
+
+			if waitErr == lsif.ErrProcessingTimeout {
+				fmt.Println("Timed out waiting for the upload to finish processing.")
+				os.Exit(exitCodeProcessingTimeout)
+			}
+			if waitErr != nil {
+				return waitErr
+			}
+			if status.State == "ERRORED" {
+				fmt.Println("Upload was rejected during processing: " + status.Failure)
+				os.Exit(exitCodeProcessingErrored)
+			}
+			fmt.Println("Processing completed successfully.")
+		}
+
 		return nil
 	}
 
@@ -269,46 +381,3 @@ Examples:
 		usageFunc: usageFunc,
 	})
 }
-
-func gzipReader(r io.Reader) (io.Reader, <-chan error) {
-	ch := make(chan error)
-	br := bufio.NewReader(r)
-	pr, pw := io.Pipe()
-	gw := gzip.NewWriter(pw)
-
-	go func() {
-		defer close(ch)
-		defer pw.Close() // must be closed 2nd
-		defer gw.Close() // must be closed 1st
-
-		if _, err := br.WriteTo(gw); err != nil {
-			ch <- err
-		}
-	}()
-
-	return pr, ch
-}
-
-// parseRemoteURL takes remote URLs such as:
-//
-// git@github.com:gorilla/mux.git
-// https://github.com/gorilla/mux.git
-//
-// and returns:
-//
-// github.com/gorilla/mux
-func parseRemoteURL(urlString string) (string, error) {
-	if strings.HasPrefix(urlString, "git@") {
-		parts := strings.Split(urlString, ":")
-		if len(parts) != 2 {
-			return "", fmt.Errorf("unrecognized remote URL: %s", urlString)
-		}
-		return strings.TrimPrefix(parts[0], "git@") + "/" + strings.TrimPrefix(strings.TrimSuffix(parts[1], ".git"), "/"), nil
-	}
-
-	remoteURL, err := url.Parse(urlString)
-	if err != nil {
-		return "", fmt.Errorf("unrecognized remote URL: %s", urlString)
-	}
-	return remoteURL.Hostname() + strings.TrimSuffix(remoteURL.Path, ".git"), nil
-}
@@ -0,0 +1,184 @@
+package main
+
+import (
+	"fmt"
+	"net/url"
+	"os/exec"
+	"regexp"
+	"strings"
+)
+
+// resolveRepositoryFromGit detects the Sourcegraph repository name for the
+// current working directory's git checkout. It picks a remote (preferring
+// remoteName if set, else "origin", else whichever remote git lists
+// first), applies any url.<base>.insteadOf rewrites configured for that
+// remote's URL, and parses the (possibly rewritten) URL into a repository
+// name, resolving SSH host aliases from ~/.ssh/config for ssh:// and
+// scp-like remotes along the way.
+//
+// It returns the repository name and a short description of how it was
+// derived, suitable for logging.
+func resolveRepositoryFromGit(remoteName string) (repo, rule string, err error) {
+	remoteName, err = resolveRemoteName(remoteName)
+	if err != nil {
+		return "", "", err
+	}
+
+	remoteURL, err := exec.Command("git", "remote", "get-url", remoteName).Output()
+	if err != nil {
+		return "", "", fmt.Errorf("failed to get URL for remote %q: %w", remoteName, err)
+	}
+
+	rewritten, insteadOfRule := applyInsteadOf(strings.TrimSpace(string(remoteURL)))
+
+	repo, err = parseRemoteURL(rewritten)
+	if err != nil {
+		return "", "", err
+	}
+
+	rule = fmt.Sprintf("remote %q", remoteName)
+	if insteadOfRule != "" {
+		rule += fmt.Sprintf(", rewritten by %s", insteadOfRule)
+	}
+	return repo, rule, nil
+}
+
+// resolveRemoteName picks which git remote to use: explicit, if given (an
+// error is returned if no such remote exists); otherwise "origin", if it
+// exists; otherwise the first remote `git remote` lists.
+func resolveRemoteName(explicit string) (string, error) {
+	out, err := exec.Command("git", "remote").Output()
+	if err != nil {
+		return "", fmt.Errorf("failed to list git remotes: %w", err)
+	}
+
+	remotes := strings.Fields(string(out))
+	if len(remotes) == 0 {
+		return "", fmt.Errorf("no git remotes configured")
+	}
+
+	if explicit != "" {
+		for _, r := range remotes {
+			if r == explicit {
+				return explicit, nil
+			}
+		}
+		return "", fmt.Errorf("no such git remote: %s", explicit)
+	}
+
+	for _, r := range remotes {
+		if r == "origin" {
+			return "origin", nil
+		}
+	}
+	return remotes[0], nil
+}
+
+// insteadOfRule holds one url.<base>.insteadOf rewrite rule.
+type insteadOfRule struct {
+	base      string
+	insteadOf string
+}
+
+// applyInsteadOf rewrites urlString according to any url.<base>.insteadOf
+// rules in the user's git config, mirroring the rewriting git itself
+// performs before fetching/pushing. The longest matching insteadOf prefix
+// wins, matching git's own behavior. It returns the rewritten URL (or the
+// original, if no rule matched) and a description of the rule applied.
+func applyInsteadOf(urlString string) (string, string) {
+	out, err := exec.Command("git", "config", "--get-regexp", `^url\..*\.insteadof$`).Output()
+	if err != nil {
+		// No insteadOf rules configured (or no git config at all); not an error.
+		return urlString, ""
+	}
+
+	var rules []insteadOfRule
+	for _, line := range strings.Split(strings.TrimSpace(string(out)), "\n") {
+		fields := strings.SplitN(line, " ", 2)
+		if len(fields) != 2 {
+			continue
+		}
+		key, insteadOf := fields[0], fields[1]
+		base := strings.TrimSuffix(strings.TrimPrefix(key, "url."), ".insteadof")
+		rules = append(rules, insteadOfRule{base: base, insteadOf: insteadOf})
+	}
+
+	var best *insteadOfRule
+	for i, rule := range rules {
+		if strings.HasPrefix(urlString, rule.insteadOf) {
+			if best == nil || len(rule.insteadOf) > len(best.insteadOf) {
+				best = &rules[i]
+			}
+		}
+	}
+	if best == nil {
+		return urlString, ""
+	}
+
+	rewritten := best.base + strings.TrimPrefix(urlString, best.insteadOf)
+	return rewritten, fmt.Sprintf("url.%s.insteadOf=%s", best.base, best.insteadOf)
+}
+
+// scpLikeURL matches the scp-like syntax git accepts for SSH remotes, e.g.
+// "git@github.com:owner/repo.git" or "gh-work:owner/repo". It deliberately
+// requires the host to contain no slashes, so it doesn't also match
+// absolute local paths like "/home/user/repo.git".
+var scpLikeURL = regexp.MustCompile(`^(?:[^@/]+@)?([^:/]+):(.+)$`)
+
+// parseRemoteURL takes remote URLs such as:
+//
+// git@github.com:gorilla/mux.git
+// https://github.com/gorilla/mux.git
+// ssh://git@host.example.com:2222/gorilla/mux
+// git://github.com/gorilla/mux.git
+// git@gh-work:gorilla/mux.git (where gh-work is a Host alias in ~/.ssh/config)
+//
+// and returns:
+//
+// github.com/gorilla/mux
+//
+// SSH Host aliases are only resolved for ssh:// and scp-like URLs: both are
+// inherently handled by the ssh client, so a ~/.ssh/config Host block is
+// fair game. An https:// or git:// URL never goes through ssh, so its host
+// is used as-is; resolving it anyway risks a wildcard Host block (e.g.
+// "Host * / HostName ...", common in corporate setups) silently rewriting
+// an unrelated HTTPS remote.
+func parseRemoteURL(urlString string) (string, error) {
+	if strings.Contains(urlString, "://") {
+		parsed, err := url.Parse(urlString)
+		if err != nil {
+			return "", fmt.Errorf("unrecognized remote URL: %s", urlString)
+		}
+		host := parsed.Hostname()
+		if parsed.Scheme == "ssh" {
+			host = resolveSSHHostAlias(host)
+		}
+		return host + strings.TrimSuffix(parsed.Path, ".git"), nil
+	}
+
+	if m := scpLikeURL.FindStringSubmatch(urlString); m != nil {
+		host := resolveSSHHostAlias(m[1])
+		return host + "/" + strings.TrimSuffix(strings.TrimPrefix(m[2], "/"), ".git"), nil
+	}
+
+	return "", fmt.Errorf("unrecognized remote URL: %s", urlString)
+}
+
+// resolveSSHHostAlias resolves a Host alias defined in ~/.ssh/config (e.g.
+// "gh-work" -> "github.com") by asking ssh to print its merged
+// configuration for that host. If ssh isn't available or the host isn't
+// aliased, host is returned unchanged.
+func resolveSSHHostAlias(host string) string {
+	out, err := exec.Command("ssh", "-G", host).Output()
+	if err != nil {
+		return host
+	}
+
+	for _, line := range strings.Split(string(out), "\n") {
+		fields := strings.SplitN(line, " ", 2)
+		if len(fields) == 2 && fields[0] == "hostname" {
+			return fields[1]
+		}
+	}
+	return host
+}
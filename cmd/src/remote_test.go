@@ -0,0 +1,112 @@
+package main
+
+import (
+	"io/ioutil"
+	"os"
+	"os/exec"
+	"path/filepath"
+	"testing"
+)
+
+func TestParseRemoteURL(t *testing.T) {
+	tests := []struct {
+		name    string
+		url     string
+		want    string
+		wantErr bool
+	}{
+		{
+			name: "scp-like",
+			url:  "git@github.com:gorilla/mux.git",
+			want: "github.com/gorilla/mux",
+		},
+		{
+			name: "scp-like without .git suffix",
+			url:  "git@github.com:gorilla/mux",
+			want: "github.com/gorilla/mux",
+		},
+		{
+			name: "https",
+			url:  "https://github.com/gorilla/mux.git",
+			want: "github.com/gorilla/mux",
+		},
+		{
+			name: "ssh scheme with port",
+			url:  "ssh://git@ghe.example.com:2222/gorilla/mux.git",
+			want: "ghe.example.com/gorilla/mux",
+		},
+		{
+			name: "git scheme",
+			url:  "git://github.com/gorilla/mux.git",
+			want: "github.com/gorilla/mux",
+		},
+		{
+			name:    "unrecognized",
+			url:     "not a url at all",
+			wantErr: true,
+		},
+	}
+
+	for _, test := range tests {
+		t.Run(test.name, func(t *testing.T) {
+			got, err := parseRemoteURL(test.url)
+			if test.wantErr {
+				if err == nil {
+					t.Fatalf("parseRemoteURL(%q) = %q, want error", test.url, got)
+				}
+				return
+			}
+			if err != nil {
+				t.Fatalf("parseRemoteURL(%q) returned error: %v", test.url, err)
+			}
+			if got != test.want {
+				t.Errorf("parseRemoteURL(%q) = %q, want %q", test.url, got, test.want)
+			}
+		})
+	}
+}
+
+func TestParseRemoteURLOnlyResolvesSSHAliasesForSSHRemotes(t *testing.T) {
+	if _, err := exec.LookPath("sh"); err != nil {
+		t.Skip("sh not available")
+	}
+
+	// ssh reads ~/.ssh/config from the user's passwd entry, not $HOME, so a
+	// fake ssh on PATH stands in for one with a wildcard Host block: its
+	// `ssh -G` output resolves every host to aliased.example.com.
+	bin, err := ioutil.TempDir("", "src-cli-ssh-config-test-*")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer os.RemoveAll(bin)
+
+	script := "#!/bin/sh\necho 'user git'\necho 'hostname aliased.example.com'\n"
+	if err := ioutil.WriteFile(filepath.Join(bin, "ssh"), []byte(script), 0700); err != nil {
+		t.Fatal(err)
+	}
+
+	oldPath := os.Getenv("PATH")
+	os.Setenv("PATH", bin+string(os.PathListSeparator)+oldPath)
+	defer os.Setenv("PATH", oldPath)
+
+	if got, err := parseRemoteURL("https://github.com/gorilla/mux.git"); err != nil {
+		t.Fatal(err)
+	} else if got != "github.com/gorilla/mux" {
+		t.Errorf("https:// remote was rewritten by a wildcard SSH Host alias: %q", got)
+	}
+
+	if got, err := parseRemoteURL("ssh://git@github.com/gorilla/mux.git"); err != nil {
+		t.Fatal(err)
+	} else if got != "aliased.example.com/gorilla/mux" {
+		t.Errorf("ssh:// remote was not resolved through the Host alias: %q", got)
+	}
+}
+
+func TestApplyInsteadOf(t *testing.T) {
+	// applyInsteadOf shells out to `git config`, so without a configured
+	// insteadOf rule in this environment it should be a no-op.
+	got, rule := applyInsteadOf("https://github.com/gorilla/mux.git")
+	if got != "https://github.com/gorilla/mux.git" {
+		t.Errorf("applyInsteadOf() rewrote URL unexpectedly: %q (rule %q)", got, rule)
+	}
+}
@@ -0,0 +1,121 @@
+package transfer
+
+import (
+	"bufio"
+	"context"
+	"encoding/json"
+	"fmt"
+	"io"
+	"io/ioutil"
+	"os"
+	"os/exec"
+)
+
+func init() {
+	Register("external", func() Adapter { return &ExternalAdapter{} })
+}
+
+// ExternalAdapter hands the dump off to a user-configured subprocess (set
+// via -transfer-agent-path) that speaks a small line-delimited JSON
+// protocol on its stdio, matching Git LFS's custom-transfer agent
+// convention. The agent is responsible for getting the bytes into whatever
+// object store the operator has chosen and reporting back the resulting
+// location.
+type ExternalAdapter struct {
+	// AgentPath is the path to the subprocess to invoke.
+	AgentPath string
+}
+
+func (a *ExternalAdapter) Name() string { return "external" }
+
+// externalEvent is a single line of the external-adapter protocol, used for
+// both directions: the CLI sends {"event":"upload",...} and the agent
+// responds with {"event":"complete",...} or {"event":"error",...}.
+type externalEvent struct {
+	Event string `json:"event"`
+
+	// OID is the sha256 of the (uncompressed) dump, mirroring Git LFS's use
+	// of a content-addressable hash to name/dedupe objects in the transfer
+	// agent's object store. It is not the git commit the dump was generated
+	// for.
+	OID      string `json:"oid,omitempty"`
+	Size     int64  `json:"size,omitempty"`
+	Path     string `json:"path,omitempty"`
+	Location string `json:"location,omitempty"`
+	Error    string `json:"error,omitempty"`
+}
+
+func (a *ExternalAdapter) Upload(ctx context.Context, src io.Reader, size int64, hints map[string]string) (string, error) {
+	if a.AgentPath == "" {
+		return "", fmt.Errorf("-transfer=external requires -transfer-agent-path to be set")
+	}
+
+	// The agent reads the dump from a file path rather than stdin, so that
+	// it's free to retry, multipart, or seek without buffering the whole
+	// thing in memory itself.
+	tmp, err := ioutil.TempFile("", "lsif-dump-*.gz")
+	if err != nil {
+		return "", err
+	}
+	defer os.Remove(tmp.Name())
+	defer tmp.Close()
+
+	if _, err := io.Copy(tmp, src); err != nil {
+		return "", err
+	}
+
+	cmd := exec.CommandContext(ctx, a.AgentPath)
+	stdin, err := cmd.StdinPipe()
+	if err != nil {
+		return "", err
+	}
+	stdout, err := cmd.StdoutPipe()
+	if err != nil {
+		return "", err
+	}
+	cmd.Stderr = os.Stderr
+
+	if err := cmd.Start(); err != nil {
+		return "", fmt.Errorf("starting transfer agent %s: %w", a.AgentPath, err)
+	}
+
+	enc := json.NewEncoder(stdin)
+	if err := enc.Encode(externalEvent{
+		Event: "upload",
+		OID:   hints["sha256"],
+		Size:  size,
+		Path:  tmp.Name(),
+	}); err != nil {
+		return "", err
+	}
+	stdin.Close()
+
+	var result externalEvent
+	scanner := bufio.NewScanner(stdout)
+	for scanner.Scan() {
+		line := scanner.Bytes()
+		if len(line) == 0 {
+			continue
+		}
+		if err := json.Unmarshal(line, &result); err != nil {
+			continue
+		}
+		if result.Event == "complete" || result.Event == "error" {
+			break
+		}
+	}
+
+	waitErr := cmd.Wait()
+
+	if result.Event == "error" {
+		return "", fmt.Errorf("transfer agent reported an error: %s", result.Error)
+	}
+	if waitErr != nil {
+		return "", fmt.Errorf("transfer agent exited with an error: %w", waitErr)
+	}
+	if result.Event != "complete" || result.Location == "" {
+		return "", fmt.Errorf("transfer agent did not report a completed upload location")
+	}
+
+	return result.Location, nil
+}
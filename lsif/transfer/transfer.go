@@ -0,0 +1,67 @@
+// Package transfer defines pluggable adapters that move an LSIF dump's
+// bytes from the client to wherever Sourcegraph will read them from, so
+// operators can swap the default gzip-POST path for one that pushes
+// directly into their own object storage (S3, GCS, Azure Blob, ...).
+package transfer
+
+import (
+	"context"
+	"fmt"
+	"io"
+)
+
+// Adapter uploads a single LSIF dump and reports back the URL Sourcegraph
+// should read it from, or, for an adapter that uploads to Sourcegraph
+// itself, the resulting upload ID.
+type Adapter interface {
+	// Name identifies the adapter, e.g. for -transfer=<name> and for log
+	// output.
+	Name() string
+
+	// Upload transfers size bytes read from src and returns the URL the
+	// dump can subsequently be fetched from, or a DirectUploadPrefix-tagged
+	// upload ID when the dump went straight to Sourcegraph (as with
+	// BasicAdapter). hints carries metadata about
+	// the upload (repository, commit, root, indexer) that an adapter may
+	// use to name or tag the resulting object.
+	Upload(ctx context.Context, src io.Reader, size int64, hints map[string]string) (locationURL string, err error)
+}
+
+// byName is the registry of built-in adapters, keyed by the value accepted
+// by the -transfer flag.
+var byName = map[string]func() Adapter{}
+
+// Register adds a constructor for a named adapter. It is called from the
+// init() of each adapter implementation in this package.
+func Register(name string, newAdapter func() Adapter) {
+	byName[name] = newAdapter
+}
+
+// Get looks up a registered adapter constructor by name.
+func Get(name string) (func() Adapter, bool) {
+	newAdapter, ok := byName[name]
+	return newAdapter, ok
+}
+
+// Names returns the names of all registered adapters.
+func Names() []string {
+	names := make([]string, 0, len(byName))
+	for name := range byName {
+		names = append(names, name)
+	}
+	return names
+}
+
+// StatusError is returned by an Adapter when the upload request completes
+// but the server responds with a non-2xx status code, so callers can
+// inspect the body for known error conditions (e.g. a missing
+// github_token).
+type StatusError struct {
+	StatusCode int
+	Status     string
+	Body       []byte
+}
+
+func (e *StatusError) Error() string {
+	return fmt.Sprintf("error: %s\n\n%s", e.Status, e.Body)
+}
@@ -0,0 +1,154 @@
+package transfer
+
+import (
+	"context"
+	"io/ioutil"
+	"net/http"
+	"net/http/httptest"
+	"os/exec"
+	"path/filepath"
+	"strings"
+	"testing"
+)
+
+func TestBuiltinAdaptersRegistered(t *testing.T) {
+	for _, name := range []string{"basic", "external"} {
+		if _, ok := Get(name); !ok {
+			t.Errorf("expected %q adapter to be registered", name)
+		}
+	}
+}
+
+func TestBasicAdapterUpload(t *testing.T) {
+	tests := []struct {
+		name       string
+		statusCode int
+		body       string
+		wantLoc    string
+		wantErr    bool
+	}{
+		{
+			name:       "success",
+			statusCode: http.StatusOK,
+			body:       `{"id":"42"}`,
+			wantLoc:    DirectUploadPrefix + "42",
+		},
+		{
+			name:       "non-2xx response is a StatusError",
+			statusCode: http.StatusUnauthorized,
+			body:       "you must provide github_token",
+			wantErr:    true,
+		},
+	}
+
+	for _, test := range tests {
+		t.Run(test.name, func(t *testing.T) {
+			var gotMethod, gotPath string
+			srv := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+				gotMethod = r.Method
+				gotPath = r.URL.Path
+				w.WriteHeader(test.statusCode)
+				w.Write([]byte(test.body))
+			}))
+			defer srv.Close()
+
+			adapter := &BasicAdapter{Endpoint: srv.URL, AccessToken: "tok"}
+			loc, err := adapter.Upload(context.Background(), strings.NewReader("gzipped-bytes"), 13, map[string]string{
+				"repository": "github.com/gorilla/mux",
+				"commit":     "deadbeef",
+			})
+
+			if test.wantErr {
+				statusErr, ok := err.(*StatusError)
+				if !ok {
+					t.Fatalf("Upload() error = %#v, want *StatusError", err)
+				}
+				if statusErr.StatusCode != test.statusCode {
+					t.Errorf("StatusError.StatusCode = %d, want %d", statusErr.StatusCode, test.statusCode)
+				}
+				return
+			}
+			if err != nil {
+				t.Fatalf("Upload() returned error: %v", err)
+			}
+			if loc != test.wantLoc {
+				t.Errorf("Upload() = %q, want %q", loc, test.wantLoc)
+			}
+			if gotMethod != "POST" {
+				t.Errorf("request method = %q, want POST", gotMethod)
+			}
+			if gotPath != "/.api/lsif/upload" {
+				t.Errorf("request path = %q, want /.api/lsif/upload", gotPath)
+			}
+		})
+	}
+}
+
+// writeAgentScript writes body to an executable shell script in a temporary
+// directory and returns its path, standing in for a real -transfer-agent-path
+// subprocess in tests.
+func writeAgentScript(t *testing.T, body string) string {
+	t.Helper()
+	path := filepath.Join(t.TempDir(), "agent.sh")
+	if err := ioutil.WriteFile(path, []byte(body), 0700); err != nil {
+		t.Fatal(err)
+	}
+	return path
+}
+
+func TestExternalAdapterUpload(t *testing.T) {
+	if _, err := exec.LookPath("sh"); err != nil {
+		t.Skip("sh not available")
+	}
+
+	tests := []struct {
+		name    string
+		script  string
+		wantLoc string
+		wantErr string
+	}{
+		{
+			name:    "success",
+			script:  "#!/bin/sh\ncat >/dev/null\necho '{\"event\":\"complete\",\"location\":\"s3://bucket/dump.gz\"}'\n",
+			wantLoc: "s3://bucket/dump.gz",
+		},
+		{
+			name:    "agent reports an error event",
+			script:  "#!/bin/sh\ncat >/dev/null\necho '{\"event\":\"error\",\"error\":\"disk full\"}'\n",
+			wantErr: "disk full",
+		},
+		{
+			name:    "malformed output never reports completion",
+			script:  "#!/bin/sh\ncat >/dev/null\necho 'not json'\n",
+			wantErr: "did not report a completed upload location",
+		},
+	}
+
+	for _, test := range tests {
+		t.Run(test.name, func(t *testing.T) {
+			adapter := &ExternalAdapter{AgentPath: writeAgentScript(t, test.script)}
+
+			loc, err := adapter.Upload(context.Background(), strings.NewReader("gzipped-bytes"), 13, map[string]string{"sha256": "deadbeef"})
+
+			if test.wantErr != "" {
+				if err == nil || !strings.Contains(err.Error(), test.wantErr) {
+					t.Fatalf("Upload() error = %v, want containing %q", err, test.wantErr)
+				}
+				return
+			}
+			if err != nil {
+				t.Fatalf("Upload() returned error: %v", err)
+			}
+			if loc != test.wantLoc {
+				t.Errorf("Upload() = %q, want %q", loc, test.wantLoc)
+			}
+		})
+	}
+}
+
+func TestExternalAdapterUploadRequiresAgentPath(t *testing.T) {
+	adapter := &ExternalAdapter{}
+	if _, err := adapter.Upload(context.Background(), strings.NewReader(""), 0, nil); err == nil {
+		t.Error("Upload() with no AgentPath should return an error")
+	}
+}
@@ -0,0 +1,523 @@
+// Package lsif contains the client-side logic for uploading LSIF dumps to a
+// Sourcegraph instance, including the resumable, chunked batch upload
+// protocol and its single-shot fallback.
+package lsif
+
+import (
+	"bytes"
+	"compress/gzip"
+	"context"
+	"crypto/sha256"
+	"encoding/hex"
+	"encoding/json"
+	"fmt"
+	"io"
+	"io/ioutil"
+	"net/http"
+	"os"
+	"strings"
+	"time"
+
+	"github.com/sourcegraph/src-cli/lsif/transfer"
+)
+
+// DefaultChunkSize is the chunk size used to split an LSIF dump into parts
+// for the batch upload protocol when the caller does not specify one.
+const DefaultChunkSize = 32 * 1024 * 1024 // 32MiB
+
+// DefaultMaxRetries is the number of attempts (the first try included) made
+// to upload a single part before the upload is aborted.
+const DefaultMaxRetries = 5
+
+// Uploader uploads LSIF dumps to a Sourcegraph instance.
+type Uploader struct {
+	// Endpoint is the base URL of the Sourcegraph instance (e.g. https://sourcegraph.com).
+	Endpoint string
+
+	// AccessToken, if non-empty, is sent on every request in an
+	// "Authorization: token <AccessToken>" header.
+	AccessToken string
+
+	// HTTPClient is used to make all requests. If nil, http.DefaultClient is used.
+	HTTPClient *http.Client
+
+	// ChunkSize is the size, in bytes, of each part uploaded via the batch
+	// protocol. Defaults to DefaultChunkSize.
+	ChunkSize int64
+
+	// PreferredTransfer, if non-empty, is the transfer adapter the user
+	// explicitly asked for via -transfer. When empty, UploadBatch is free to
+	// switch to a server-preferred adapter (see batchResponse.PreferredAdapters).
+	PreferredTransfer string
+
+	// TransferAgentPath is the subprocess used by the "external" transfer
+	// adapter. It must be set for UploadBatch to be able to switch to the
+	// "external" adapter on the server's recommendation.
+	TransferAgentPath string
+
+	// Log, if non-nil, is called with human-readable progress messages.
+	Log func(format string, args ...interface{})
+}
+
+// Manifest describes the LSIF dump being uploaded, sent to the batch
+// endpoint before any bytes are transferred.
+type Manifest struct {
+	Repository  string `json:"repository"`
+	Commit      string `json:"commit"`
+	Root        string `json:"root"`
+	Indexer     string `json:"indexer,omitempty"`
+	TotalSize   int64  `json:"totalSize"`
+	SHA256      string `json:"sha256"`
+	ChunkSize   int64  `json:"chunkSize"`
+	ResumeToken string `json:"resumeToken,omitempty"`
+	GithubToken string `json:"github_token,omitempty"`
+}
+
+// PartAction describes where and how to upload a single part of the dump,
+// mirroring the shape of the Git LFS batch API's actions.upload objects.
+type PartAction struct {
+	PartNumber int               `json:"part_number"`
+	Offset     int64             `json:"offset"`
+	Length     int64             `json:"length"`
+	URL        string            `json:"url"`
+	Header     map[string]string `json:"header,omitempty"`
+	ExpiresAt  time.Time         `json:"expires_at"`
+
+	// ETag is set on parts the server already has, so a resumed upload can
+	// skip re-uploading them.
+	ETag string `json:"etag,omitempty"`
+}
+
+// batchResponse is returned by the /.api/lsif/upload/batch endpoint.
+type batchResponse struct {
+	Token string       `json:"token"`
+	Parts []PartAction `json:"parts"`
+
+	// PreferredAdapters, if set, lists transfer adapter names (see the
+	// lsif/transfer package) the server would rather the client use, in
+	// preference order. UploadBatch switches to the first preferred adapter
+	// it can actually use (see Uploader.preferredAdapter), unless the user
+	// explicitly requested a -transfer adapter via Uploader.PreferredTransfer.
+	PreferredAdapters []string `json:"preferred_adapters,omitempty"`
+}
+
+// partResult is sent back to the finalize endpoint for each uploaded part.
+type partResult struct {
+	PartNumber int    `json:"part_number"`
+	ETag       string `json:"etag"`
+}
+
+// UploadResult is returned on a successful upload.
+type UploadResult struct {
+	ID string `json:"id"`
+}
+
+// ErrBatchUnsupported is returned internally when the server does not
+// support the batch upload protocol (a 404 from /.api/lsif/upload/batch).
+var ErrBatchUnsupported = fmt.Errorf("batch upload endpoint not supported by this Sourcegraph instance")
+
+func (u *Uploader) client() *http.Client {
+	if u.HTTPClient != nil {
+		return u.HTTPClient
+	}
+	return http.DefaultClient
+}
+
+func (u *Uploader) logf(format string, args ...interface{}) {
+	if u.Log != nil {
+		u.Log(format, args...)
+	}
+}
+
+func (u *Uploader) chunkSize() int64 {
+	if u.ChunkSize > 0 {
+		return u.ChunkSize
+	}
+	return DefaultChunkSize
+}
+
+func (u *Uploader) newRequest(method, url string, body io.Reader) (*http.Request, error) {
+	req, err := http.NewRequest(method, url, body)
+	if err != nil {
+		return nil, err
+	}
+	if u.AccessToken != "" {
+		req.Header.Set("Authorization", "token "+u.AccessToken)
+	}
+	return req, nil
+}
+
+// UploadBatch performs a resumable, chunked upload of the dump at path using
+// the batch handshake protocol. If the server does not support the batch
+// endpoint, ErrBatchUnsupported is returned so the caller can fall back to
+// the single-shot path.
+func (u *Uploader) UploadBatch(path, repo, commit, root, indexer, resumeToken, githubToken string) (*UploadResult, error) {
+	size, sum, err := hashFile(path)
+	if err != nil {
+		return nil, err
+	}
+
+	manifest := Manifest{
+		Repository:  repo,
+		Commit:      commit,
+		Root:        root,
+		Indexer:     indexer,
+		TotalSize:   size,
+		SHA256:      sum,
+		ChunkSize:   u.chunkSize(),
+		ResumeToken: resumeToken,
+		GithubToken: githubToken,
+	}
+
+	body, err := json.Marshal(manifest)
+	if err != nil {
+		return nil, err
+	}
+
+	req, err := u.newRequest("POST", u.Endpoint+"/.api/lsif/upload/batch", bytes.NewReader(body))
+	if err != nil {
+		return nil, err
+	}
+	req.Header.Set("Content-Type", "application/json")
+
+	resp, err := u.client().Do(req)
+	if err != nil {
+		return nil, err
+	}
+	defer resp.Body.Close()
+
+	if resp.StatusCode == http.StatusNotFound {
+		return nil, ErrBatchUnsupported
+	}
+	respBody, err := ioutil.ReadAll(resp.Body)
+	if err != nil {
+		return nil, err
+	}
+	if resp.StatusCode < 200 || resp.StatusCode >= 300 {
+		return nil, &StatusError{StatusCode: resp.StatusCode, Status: resp.Status, Body: respBody}
+	}
+
+	var batch batchResponse
+	if err := json.Unmarshal(respBody, &batch); err != nil {
+		return nil, err
+	}
+
+	if resumeToken != "" {
+		u.logf("Resuming upload %s (%d parts)", batch.Token, len(batch.Parts))
+	} else {
+		u.logf("Starting upload (resume with -resume-from=%s if it fails)", batch.Token)
+	}
+	if len(batch.PreferredAdapters) > 0 {
+		u.logf("Server prefers transfer adapters: %s", strings.Join(batch.PreferredAdapters, ", "))
+	}
+
+	if adapter := u.preferredAdapter(batch.PreferredAdapters); adapter != nil {
+		u.logf("Switching to %q transfer adapter per server preference", adapter.Name())
+		return u.UploadViaAdapter(path, repo, commit, root, indexer, githubToken, adapter)
+	}
+
+	results := make([]partResult, 0, len(batch.Parts))
+	for _, part := range batch.Parts {
+		if part.ETag != "" {
+			u.logf("Skipping part %d, already uploaded (etag %s)", part.PartNumber, part.ETag)
+			results = append(results, partResult{PartNumber: part.PartNumber, ETag: part.ETag})
+			continue
+		}
+
+		etag, err := u.uploadPartWithRetry(path, part)
+		if err != nil {
+			return nil, fmt.Errorf("uploading part %d: %w (resume with -resume-from=%s)", part.PartNumber, err, batch.Token)
+		}
+		results = append(results, partResult{PartNumber: part.PartNumber, ETag: etag})
+	}
+
+	return u.finalize(batch.Token, results)
+}
+
+// preferredAdapter returns the transfer adapter UploadBatch should switch to
+// instead of continuing the chunked part upload, or nil to continue as
+// normal. It defers entirely to the user's explicit -transfer choice
+// (u.PreferredTransfer); only when the user left that unset does it honor
+// the server's preference, and only for adapters this Uploader is actually
+// configured to use.
+func (u *Uploader) preferredAdapter(serverPreferred []string) transfer.Adapter {
+	if u.PreferredTransfer != "" {
+		return nil
+	}
+	for _, name := range serverPreferred {
+		switch name {
+		case "basic":
+			// Already what UploadBatch/UploadSingleShot do; nothing to switch to.
+			return nil
+		case "external":
+			if u.TransferAgentPath != "" {
+				return &transfer.ExternalAdapter{AgentPath: u.TransferAgentPath}
+			}
+		}
+	}
+	return nil
+}
+
+func (u *Uploader) uploadPartWithRetry(path string, part PartAction) (string, error) {
+	var lastErr error
+	for attempt := 0; attempt < DefaultMaxRetries; attempt++ {
+		if attempt > 0 {
+			backoff := time.Duration(1<<uint(attempt)) * time.Second
+			u.logf("Retrying part %d in %s (attempt %d/%d): %v", part.PartNumber, backoff, attempt+1, DefaultMaxRetries, lastErr)
+			time.Sleep(backoff)
+		}
+
+		etag, err := u.uploadPart(path, part)
+		if err == nil {
+			return etag, nil
+		}
+		lastErr = err
+	}
+	return "", lastErr
+}
+
+func (u *Uploader) uploadPart(path string, part PartAction) (string, error) {
+	f, err := os.Open(path)
+	if err != nil {
+		return "", err
+	}
+	defer f.Close()
+
+	if _, err := f.Seek(part.Offset, io.SeekStart); err != nil {
+		return "", err
+	}
+
+	req, err := u.newRequest("PUT", part.URL, io.LimitReader(f, part.Length))
+	if err != nil {
+		return "", err
+	}
+	req.ContentLength = part.Length
+	req.Header.Set("Content-Range", fmt.Sprintf("bytes %d-%d/*", part.Offset, part.Offset+part.Length-1))
+	for k, v := range part.Header {
+		req.Header.Set(k, v)
+	}
+
+	resp, err := u.client().Do(req)
+	if err != nil {
+		return "", err
+	}
+	defer resp.Body.Close()
+	io.Copy(ioutil.Discard, resp.Body)
+
+	if resp.StatusCode < 200 || resp.StatusCode >= 300 {
+		return "", fmt.Errorf("part upload failed: %s", resp.Status)
+	}
+
+	etag := resp.Header.Get("ETag")
+	if etag == "" {
+		return "", fmt.Errorf("part upload response did not include an ETag")
+	}
+	return etag, nil
+}
+
+func (u *Uploader) finalize(token string, parts []partResult) (*UploadResult, error) {
+	body, err := json.Marshal(struct {
+		Token string       `json:"token"`
+		Parts []partResult `json:"parts"`
+	}{Token: token, Parts: parts})
+	if err != nil {
+		return nil, err
+	}
+
+	req, err := u.newRequest("POST", u.Endpoint+"/.api/lsif/upload/batch/finalize", bytes.NewReader(body))
+	if err != nil {
+		return nil, err
+	}
+	req.Header.Set("Content-Type", "application/json")
+
+	resp, err := u.client().Do(req)
+	if err != nil {
+		return nil, err
+	}
+	defer resp.Body.Close()
+
+	respBody, err := ioutil.ReadAll(resp.Body)
+	if err != nil {
+		return nil, err
+	}
+	if resp.StatusCode < 200 || resp.StatusCode >= 300 {
+		return nil, &StatusError{StatusCode: resp.StatusCode, Status: resp.Status, Body: respBody}
+	}
+
+	var result UploadResult
+	if err := json.Unmarshal(respBody, &result); err != nil {
+		return nil, err
+	}
+	return &result, nil
+}
+
+// UploadViaAdapter gzip-compresses the dump at path and hands it off to the
+// given transfer.Adapter, rather than streaming it through the resumable
+// batch protocol. The single-shot fallback (UploadSingleShot) goes through
+// here with the basic adapter, and this is how a `-transfer=external`
+// upload reaches an operator-controlled object store directly.
+func (u *Uploader) UploadViaAdapter(path, repo, commit, root, indexer, githubToken string, adapter transfer.Adapter) (*UploadResult, error) {
+	_, sum, err := hashFile(path)
+	if err != nil {
+		return nil, err
+	}
+
+	gzPath, size, err := gzipToTempFile(path)
+	if err != nil {
+		return nil, err
+	}
+	defer os.Remove(gzPath)
+
+	f, err := os.Open(gzPath)
+	if err != nil {
+		return nil, err
+	}
+	defer f.Close()
+
+	hints := map[string]string{
+		"repository":   repo,
+		"commit":       commit,
+		"root":         root,
+		"indexerName":  indexer,
+		"github_token": githubToken,
+		// sha256 is the content-addressable hash of the uncompressed dump,
+		// suitable for use as the "oid" in the Git LFS-style custom-transfer
+		// protocol (see transfer.ExternalAdapter). It's distinct from
+		// "commit", which identifies the revision the dump was generated
+		// for, not the dump's own content.
+		"sha256": sum,
+	}
+
+	u.logf("Uploading via %q transfer adapter", adapter.Name())
+
+	location, err := adapter.Upload(context.Background(), f, size, hints)
+	if err != nil {
+		return nil, err
+	}
+
+	if id := strings.TrimPrefix(location, transfer.DirectUploadPrefix); id != location {
+		// The adapter already completed the upload server-side (e.g. the
+		// basic adapter); there's nothing left to notify.
+		return &UploadResult{ID: id}, nil
+	}
+
+	return u.notifyExternalLocation(repo, commit, root, indexer, githubToken, location)
+}
+
+// notifyExternalLocation tells Sourcegraph that a dump has already been
+// uploaded to an object store at location, so it can fetch and process it
+// from there instead of receiving the bytes directly.
+func (u *Uploader) notifyExternalLocation(repo, commit, root, indexer, githubToken, location string) (*UploadResult, error) {
+	body, err := json.Marshal(struct {
+		Repository  string `json:"repository"`
+		Commit      string `json:"commit"`
+		Root        string `json:"root"`
+		Indexer     string `json:"indexer,omitempty"`
+		GithubToken string `json:"github_token,omitempty"`
+		Location    string `json:"location"`
+	}{
+		Repository:  repo,
+		Commit:      commit,
+		Root:        root,
+		Indexer:     indexer,
+		GithubToken: githubToken,
+		Location:    location,
+	})
+	if err != nil {
+		return nil, err
+	}
+
+	req, err := u.newRequest("POST", u.Endpoint+"/.api/lsif/upload/external", bytes.NewReader(body))
+	if err != nil {
+		return nil, err
+	}
+	req.Header.Set("Content-Type", "application/json")
+
+	resp, err := u.client().Do(req)
+	if err != nil {
+		return nil, err
+	}
+	defer resp.Body.Close()
+
+	respBody, err := ioutil.ReadAll(resp.Body)
+	if err != nil {
+		return nil, err
+	}
+	if resp.StatusCode < 200 || resp.StatusCode >= 300 {
+		return nil, &StatusError{StatusCode: resp.StatusCode, Status: resp.Status, Body: respBody}
+	}
+
+	var result UploadResult
+	if err := json.Unmarshal(respBody, &result); err != nil {
+		return nil, err
+	}
+	return &result, nil
+}
+
+// gzipToTempFile gzip-compresses the file at path into a new temporary
+// file and returns its path along with its compressed size. The caller is
+// responsible for removing the temporary file.
+func gzipToTempFile(path string) (string, int64, error) {
+	in, err := os.Open(path)
+	if err != nil {
+		return "", 0, err
+	}
+	defer in.Close()
+
+	out, err := ioutil.TempFile("", "lsif-dump-*.gz")
+	if err != nil {
+		return "", 0, err
+	}
+	defer out.Close()
+
+	gw := gzip.NewWriter(out)
+	if _, err := io.Copy(gw, in); err != nil {
+		os.Remove(out.Name())
+		return "", 0, err
+	}
+	if err := gw.Close(); err != nil {
+		os.Remove(out.Name())
+		return "", 0, err
+	}
+
+	info, err := out.Stat()
+	if err != nil {
+		os.Remove(out.Name())
+		return "", 0, err
+	}
+	return out.Name(), info.Size(), nil
+}
+
+// hashFile returns the uncompressed size and hex-encoded sha256 sum of the
+// file at path.
+func hashFile(path string) (int64, string, error) {
+	f, err := os.Open(path)
+	if err != nil {
+		return 0, "", err
+	}
+	defer f.Close()
+
+	h := sha256.New()
+	size, err := io.Copy(h, f)
+	if err != nil {
+		return 0, "", err
+	}
+	return size, hex.EncodeToString(h.Sum(nil)), nil
+}
+
+// UploadSingleShot streams the gzipped dump at path to the legacy
+// single-request upload endpoint in one request, via the "basic" transfer
+// adapter. It is used as a fallback when the server does not support the
+// batch protocol.
+func (u *Uploader) UploadSingleShot(path, repo, commit, root, indexer, githubToken string) (*UploadResult, error) {
+	return u.UploadViaAdapter(path, repo, commit, root, indexer, githubToken, &transfer.BasicAdapter{
+		Endpoint:    u.Endpoint,
+		AccessToken: u.AccessToken,
+		HTTPClient:  u.HTTPClient,
+	})
+}
+
+// StatusError is returned when an upload request completes but the server
+// responds with a non-2xx status code, so callers can inspect the body for
+// known error conditions (e.g. a missing github_token).
+type StatusError = transfer.StatusError
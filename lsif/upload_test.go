@@ -0,0 +1,32 @@
+package lsif
+
+import (
+	"io/ioutil"
+	"os"
+	"testing"
+)
+
+func TestHashFile(t *testing.T) {
+	f, err := ioutil.TempFile("", "lsif-upload-test-*")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer os.Remove(f.Name())
+
+	want := "hello, lsif"
+	if _, err := f.WriteString(want); err != nil {
+		t.Fatal(err)
+	}
+	f.Close()
+
+	size, sum, err := hashFile(f.Name())
+	if err != nil {
+		t.Fatal(err)
+	}
+	if size != int64(len(want)) {
+		t.Errorf("size = %d, want %d", size, len(want))
+	}
+	if sum == "" {
+		t.Errorf("sha256 sum should not be empty")
+	}
+}
@@ -0,0 +1,121 @@
+package lsif
+
+import (
+	"bytes"
+	"encoding/json"
+	"fmt"
+	"io/ioutil"
+	"time"
+)
+
+// ErrProcessingTimeout is returned by WaitForProcessing when the deadline
+// elapses before the upload reaches a terminal state.
+var ErrProcessingTimeout = fmt.Errorf("timed out waiting for upload to finish processing")
+
+// ProcessingStatus is a snapshot of an LSIFUpload node's processing state.
+type ProcessingStatus struct {
+	ID      string `json:"id"`
+	State   string `json:"state"`
+	Failure string `json:"failure,omitempty"`
+}
+
+// pollInterval is the delay between polls of the LsifUpload GraphQL node.
+// It's a var rather than a const so tests can shrink it.
+var pollInterval = 2 * time.Second
+
+const lsifUploadStatusQuery = `query LsifUploadStatus($id: ID!) {
+	node(id: $id) {
+		... on LSIFUpload {
+			state
+			failure
+		}
+	}
+}`
+
+// WaitForProcessing polls the LsifUpload GraphQL node identified by id
+// until its state becomes COMPLETED or ERRORED, the deadline (timeout)
+// elapses, or an error occurs making the request. onProgress, if non-nil,
+// is called after every poll with the most recently observed state. A
+// timeout of zero or less disables the deadline, so WaitForProcessing polls
+// indefinitely; callers that want "don't wait at all" shouldn't call this
+// at all rather than passing a zero timeout.
+func (u *Uploader) WaitForProcessing(id string, timeout time.Duration, onProgress func(state string)) (*ProcessingStatus, error) {
+	deadline := time.Now().Add(timeout)
+
+	for {
+		status, err := u.pollProcessingStatus(id)
+		if err != nil {
+			return nil, err
+		}
+		if onProgress != nil {
+			onProgress(status.State)
+		}
+
+		switch status.State {
+		case "COMPLETED", "ERRORED":
+			return status, nil
+		}
+
+		if timeout > 0 && time.Now().After(deadline) {
+			return status, ErrProcessingTimeout
+		}
+
+		time.Sleep(pollInterval)
+	}
+}
+
+func (u *Uploader) pollProcessingStatus(id string) (*ProcessingStatus, error) {
+	body, err := json.Marshal(struct {
+		Query     string                 `json:"query"`
+		Variables map[string]interface{} `json:"variables"`
+	}{
+		Query:     lsifUploadStatusQuery,
+		Variables: map[string]interface{}{"id": id},
+	})
+	if err != nil {
+		return nil, err
+	}
+
+	req, err := u.newRequest("POST", u.Endpoint+"/.api/graphql", bytes.NewReader(body))
+	if err != nil {
+		return nil, err
+	}
+	req.Header.Set("Content-Type", "application/json")
+
+	resp, err := u.client().Do(req)
+	if err != nil {
+		return nil, err
+	}
+	defer resp.Body.Close()
+
+	respBody, err := ioutil.ReadAll(resp.Body)
+	if err != nil {
+		return nil, err
+	}
+	if resp.StatusCode < 200 || resp.StatusCode >= 300 {
+		return nil, &StatusError{StatusCode: resp.StatusCode, Status: resp.Status, Body: respBody}
+	}
+
+	var result struct {
+		Data struct {
+			Node *struct {
+				State   string `json:"state"`
+				Failure string `json:"failure"`
+			} `json:"node"`
+		} `json:"data"`
+		Errors []struct {
+			Message string `json:"message"`
+		} `json:"errors"`
+	}
+	if err := json.Unmarshal(respBody, &result); err != nil {
+		return nil, err
+	}
+	if len(result.Errors) > 0 {
+		return nil, fmt.Errorf("graphql error: %s", result.Errors[0].Message)
+	}
+	if result.Data.Node == nil {
+		return nil, fmt.Errorf("no such LSIF upload: %s", id)
+	}
+
+	return &ProcessingStatus{ID: id, State: result.Data.Node.State, Failure: result.Data.Node.Failure}, nil
+}
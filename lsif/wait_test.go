@@ -0,0 +1,102 @@
+package lsif
+
+import (
+	"encoding/json"
+	"net/http"
+	"net/http/httptest"
+	"testing"
+	"time"
+)
+
+type statusResponse struct {
+	Data struct {
+		Node struct {
+			State   string `json:"state"`
+			Failure string `json:"failure"`
+		} `json:"node"`
+	} `json:"data"`
+}
+
+// statusServer stubs the GraphQL endpoint WaitForProcessing polls, returning
+// states in order and repeating the last one once exhausted.
+func statusServer(t *testing.T, states []string, failure string) *httptest.Server {
+	t.Helper()
+	var calls int
+	return httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		state := states[calls]
+		if calls < len(states)-1 {
+			calls++
+		}
+
+		var resp statusResponse
+		resp.Data.Node.State = state
+		if state == "ERRORED" {
+			resp.Data.Node.Failure = failure
+		}
+		json.NewEncoder(w).Encode(resp)
+	}))
+}
+
+func TestWaitForProcessing(t *testing.T) {
+	oldInterval := pollInterval
+	pollInterval = time.Millisecond
+	defer func() { pollInterval = oldInterval }()
+
+	t.Run("completes", func(t *testing.T) {
+		srv := statusServer(t, []string{"QUEUED", "PROCESSING", "COMPLETED"}, "")
+		defer srv.Close()
+
+		u := &Uploader{Endpoint: srv.URL}
+		status, err := u.WaitForProcessing("upload-id", time.Second, nil)
+		if err != nil {
+			t.Fatalf("WaitForProcessing() returned error: %v", err)
+		}
+		if status.State != "COMPLETED" {
+			t.Errorf("status.State = %q, want COMPLETED", status.State)
+		}
+	})
+
+	t.Run("errors", func(t *testing.T) {
+		srv := statusServer(t, []string{"PROCESSING", "ERRORED"}, "something went wrong")
+		defer srv.Close()
+
+		u := &Uploader{Endpoint: srv.URL}
+		status, err := u.WaitForProcessing("upload-id", time.Second, nil)
+		if err != nil {
+			t.Fatalf("WaitForProcessing() returned error: %v", err)
+		}
+		if status.State != "ERRORED" {
+			t.Errorf("status.State = %q, want ERRORED", status.State)
+		}
+		if status.Failure != "something went wrong" {
+			t.Errorf("status.Failure = %q, want %q", status.Failure, "something went wrong")
+		}
+	})
+
+	t.Run("times out", func(t *testing.T) {
+		srv := statusServer(t, []string{"PROCESSING"}, "")
+		defer srv.Close()
+
+		u := &Uploader{Endpoint: srv.URL}
+		_, err := u.WaitForProcessing("upload-id", time.Millisecond, nil)
+		if err != ErrProcessingTimeout {
+			t.Fatalf("WaitForProcessing() error = %v, want ErrProcessingTimeout", err)
+		}
+	})
+
+	t.Run("reports progress", func(t *testing.T) {
+		srv := statusServer(t, []string{"PROCESSING", "COMPLETED"}, "")
+		defer srv.Close()
+
+		var seen []string
+		u := &Uploader{Endpoint: srv.URL}
+		if _, err := u.WaitForProcessing("upload-id", time.Second, func(state string) {
+			seen = append(seen, state)
+		}); err != nil {
+			t.Fatalf("WaitForProcessing() returned error: %v", err)
+		}
+		if len(seen) == 0 || seen[len(seen)-1] != "COMPLETED" {
+			t.Errorf("onProgress saw %v, want it to end with COMPLETED", seen)
+		}
+	})
+}